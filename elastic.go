@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,9 +10,11 @@ import (
 	"log"
 	"net/http"
 	neturl "net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Connection to a specific index in ES
@@ -20,6 +23,44 @@ type EsConn struct {
 	path       string
 	types      []string
 	client     *http.Client
+	compatV1   bool // force the pre-7.x typed API instead of auto-detecting
+
+	typelessOnce sync.Once
+	typeless     bool
+
+	query         map[string]Any // nil means match_all
+	sourceInclude []string
+	sourceExclude []string
+	typesFilter   []string // nil means use whatever GetIndex discovers
+
+	resumeType string // set by SetResumeFrom; "" means export from scratch
+	resumeId   string
+}
+
+// SetQuery overrides the match_all default used to scroll this source.
+func (this *EsConn) SetQuery(q map[string]Any) {
+	this.query = q
+}
+
+// SetSourceFilter restricts the _source fields returned by the scroll.
+func (this *EsConn) SetSourceFilter(include, exclude []string) {
+	this.sourceInclude = include
+	this.sourceExclude = exclude
+}
+
+// SetTypesFilter overrides the types discovered from the index mapping
+// with an explicit allowlist.
+func (this *EsConn) SetTypesFilter(types []string) {
+	this.typesFilter = types
+}
+
+// SetResumeFrom picks up a --resume export where a checkpoint left off:
+// StreamTo skips every type before typeName entirely, then pages typeName
+// itself with search_after starting right after lastId instead of
+// rescanning it from the beginning.
+func (this *EsConn) SetResumeFrom(typeName, lastId string) {
+	this.resumeType = typeName
+	this.resumeId = lastId
 }
 
 var _ DataFlow = &EsConn{}
@@ -73,7 +114,7 @@ func parseBulkFailures(resp []byte) (fails map[string]bool, err error) {
 	return fails, nil
 }
 
-func ConnectES(url string) (*EsConn, error) {
+func ConnectES(url string, requestTimeout time.Duration, compatV1 bool) (*EsConn, error) {
 	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
 		url = "http://" + url
 	}
@@ -82,83 +123,230 @@ func ConnectES(url string) (*EsConn, error) {
 		return nil, err
 	}
 	hostPrefix := fmt.Sprintf("http://%s", u.Host)
-	return &EsConn{hostPrefix: hostPrefix, path: u.Path, client: http.DefaultClient}, nil
+	client := &http.Client{Timeout: requestTimeout}
+	return &EsConn{hostPrefix: hostPrefix, path: u.Path, client: client, compatV1: compatV1}, nil
+}
+
+// isTypeless reports whether this cluster's bulk/search API has dropped
+// mapping types (ES 7+: no `_type` in bulk metadata, no `/{type}` path
+// segment). --compat v1 forces the old typed API without probing.
+func (this *EsConn) isTypeless(ctx context.Context) bool {
+	if this.compatV1 {
+		return false
+	}
+	this.typelessOnce.Do(func() {
+		major, err := this.detectMajorVersion(ctx)
+		if err != nil {
+			log.Printf("Could not detect ES version, assuming the typed (pre-7.x) API: %v", err)
+			return
+		}
+		this.typeless = major >= 7
+	})
+	return this.typeless
 }
 
-func (this *EsConn) NewScroll(typeName string, size int) (scroll Scroll, err error) {
-	query := fmt.Sprintf(`
-        {
-            "query": {
-            	"match_all": {}
-            },
-            "size": %d
-        }
-    `, size)
-	url := fmt.Sprintf("%s%s/%s/_search?search_type=scan&scroll=5m", this.hostPrefix, this.path, typeName)
-	request, err := http.NewRequest("GET", url, bytes.NewBufferString(query))
+func (this *EsConn) detectMajorVersion(ctx context.Context) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", this.hostPrefix+"/", nil)
 	if err != nil {
-		return
+		return 0, err
 	}
-	resp, err := readRequest(this.client, request)
+	data, err := readRequest(this.client, req)
 	if err != nil {
-		return
+		return 0, err
+	}
+	var v struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
 	}
-	//
-	getScrollId := func(data []byte) (string, error) {
-		v := struct {
-			ScrollID string `json:"_scroll_id"`
-		}{}
-		err := json.Unmarshal(data, &v)
-		return v.ScrollID, err
+	if err := json.Unmarshal(data, &v); err != nil {
+		return 0, err
 	}
+	major, _, _ := strings.Cut(v.Version.Number, ".")
+	return strconv.Atoi(major)
+}
+
+type scrollResponse struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []map[string]Any `json:"hits"`
+	} `json:"hits"`
+}
+
+// searchBody builds the query/slice/_source clauses shared by a fresh scroll
+// open and a search_after follow-up page; the caller adds whichever sort/
+// pagination fields its mode needs on top.
+func (this *EsConn) searchBody(size, sliceId, slices int) map[string]Any {
+	body := map[string]Any{"size": size}
+	if this.query != nil {
+		body["query"] = this.query
+	}
+	if slices > 1 {
+		body["slice"] = map[string]int{"id": sliceId, "max": slices}
+	}
+	if len(this.sourceInclude) > 0 || len(this.sourceExclude) > 0 {
+		source := map[string]Any{}
+		if len(this.sourceInclude) > 0 {
+			source["includes"] = this.sourceInclude
+		}
+		if len(this.sourceExclude) > 0 {
+			source["excludes"] = this.sourceExclude
+		}
+		body["_source"] = source
+	}
+	return body
+}
 
-	scrollID, err := getScrollId(resp)
+func (this *EsConn) searchUrl(typeName string, ctx context.Context, scrolling bool) string {
+	suffix := "/_search"
+	if scrolling {
+		suffix = "/_search?scroll=5m"
+	}
+	if !this.isTypeless(ctx) {
+		return fmt.Sprintf("%s%s/%s%s", this.hostPrefix, this.path, typeName, suffix)
+	}
+	return fmt.Sprintf("%s%s%s", this.hostPrefix, this.path, suffix)
+}
+
+// NewScroll opens a scroll and returns its first page of hits directly,
+// matching the ES 5+ `_search?scroll=` API (the old `search_type=scan`
+// mode, removed in 5.0, required a throwaway first Next() call instead).
+// When slices > 1 the query carries a `slice` clause so this call only
+// covers its [sliceId, slices) shard range; the caller fans slices out
+// concurrently and merges them into one Batcher-fed channel.
+//
+// A fresh (non-resumed) scroll sorts by `_doc`, the cheapest order ES can
+// produce since it just walks segments in on-disk order; ES 7.6+ also
+// disallows fielddata-based sorting on `_id` by default, so `_doc` is the
+// only safe default sort here, not just the fastest.
+//
+// resumeFrom, if non-empty, skips the scroll API entirely in favor of
+// stateless search_after pagination on `_id`, starting right after that id:
+// a scroll context opened by a since-dead process would already have
+// expired by the time --resume runs, but search_after has no server-side
+// state to expire. This does mean a resumed page walks a different order
+// than the interrupted run saw; what keeps --resume correct despite that
+// is FileSink truncating its output to the exact byte offset the
+// checkpoint recorded, not this sort choice.
+func (this *EsConn) NewScroll(ctx context.Context, typeName string, size, sliceId, slices int, resumeFrom string) (scroll Scroll, hits []map[string]Any, err error) {
+	body := this.searchBody(size, sliceId, slices)
+	resuming := resumeFrom != ""
+	if resuming {
+		body["sort"] = []string{"_id"}
+		body["search_after"] = []Any{resumeFrom}
+	} else {
+		body["sort"] = []string{"_doc"}
+	}
+	bodyBytes, err := json.Marshal(body)
 	if err != nil {
 		return
 	}
-	scroll = Scroll{id: scrollID, es: this}
+	url := this.searchUrl(typeName, ctx, !resuming)
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return
+	}
+	data, err := readRequest(this.client, request)
+	if err != nil {
+		return
+	}
+	var v scrollResponse
+	if err = json.Unmarshal(data, &v); err != nil {
+		return
+	}
+	scroll = Scroll{id: v.ScrollID, es: this, typeName: typeName, size: size, sliceId: sliceId, slices: slices}
+	hits = v.Hits.Hits
+	if resuming && len(hits) > 0 {
+		scroll.searchAfter = []Any{hits[len(hits)-1]["_id"]}
+	}
 	return
 }
 
-func (this *Scroll) Next() ([]map[string]Any, error) {
-	resp, err := this.es.client.Get(this.es.hostPrefix + "/_search/scroll?scroll=5m&scroll_id=" + this.id)
+func (this *Scroll) Next(ctx context.Context) ([]map[string]Any, error) {
+	if this.searchAfter != nil {
+		body := this.es.searchBody(this.size, this.sliceId, this.slices)
+		body["sort"] = []string{"_id"}
+		body["search_after"] = this.searchAfter
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", this.es.searchUrl(this.typeName, ctx, false), bytes.NewReader(bodyBytes))
+		if err != nil {
+			return nil, err
+		}
+		data, err := readRequest(this.es.client, req)
+		if err != nil {
+			return nil, err
+		}
+		var v scrollResponse
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		if len(v.Hits.Hits) > 0 {
+			this.searchAfter = []Any{v.Hits.Hits[len(v.Hits.Hits)-1]["_id"]}
+		}
+		return v.Hits.Hits, nil
+	}
+	body, err := json.Marshal(map[string]string{"scroll": "5m", "scroll_id": this.id})
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	data, errRead := ioutil.ReadAll(resp.Body)
-	if errRead != nil {
-		return nil, errRead
+	req, err := http.NewRequestWithContext(ctx, "POST", this.es.hostPrefix+"/_search/scroll", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
 	}
-
-	hits := struct {
-		Hits struct {
-			Hits []map[string]Any `json:"hits"`
-		} `json:"hits"`
-	}{}
-	json.Unmarshal(data, &hits)
-	return hits.Hits.Hits, errRead
+	data, err := readRequest(this.es.client, req)
+	if err != nil {
+		return nil, err
+	}
+	var v scrollResponse
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	this.id = v.ScrollID
+	return v.Hits.Hits, nil
 }
 
 // returns failed bulk ops if any single one failed; error on major filure
-func (this *EsConn) Bulk(ops []Bulk) (ret []Bulk, err error) {
+func (this *EsConn) Bulk(ctx context.Context, ops []Bulk) (ret []Bulk, err error) {
+	ret, _, err = this.bulkOnce(ctx, ops)
+	return
+}
+
+// bulkOnce submits one batch and additionally reports the ES Retry-After
+// hint (0 if absent), so retryBulk can honor server-requested backoff.
+func (this *EsConn) bulkOnce(ctx context.Context, ops []Bulk) (ret []Bulk, retryAfter time.Duration, err error) {
+	typeless := this.isTypeless(ctx)
 	bodyBuf := bytes.Buffer{}
 	for _, b := range ops {
-		b.Store(&bodyBuf)
+		if typeless {
+			fmt.Fprintf(&bodyBuf, `{"create":{"_id":"%v"}}`+"\n%s\n", b.Id, b.Doc)
+		} else {
+			b.Store(&bodyBuf)
+		}
 	}
 	url := fmt.Sprintf("%s%s/_bulk", this.hostPrefix, this.path)
-	request, err := http.NewRequest("PUT", url, &bodyBuf)
+	request, err := http.NewRequestWithContext(ctx, "PUT", url, &bodyBuf)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	resp, err := readRequest(this.client, request)
+	resp, err := this.client.Do(request)
 	if err != nil {
-		return
+		return nil, 0, err
 	}
-	fails, err := parseBulkFailures(resp)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return
+		return nil, 0, err
+	}
+	retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	if resp.StatusCode >= 300 {
+		return nil, retryAfter, errors.New(fmt.Sprintf("Http error[%s]: %s", resp.Status, string(body)))
+	}
+	fails, err := parseBulkFailures(body)
+	if err != nil {
+		return nil, retryAfter, err
 	}
 	if len(fails) > 0 {
 		for _, op := range ops {
@@ -170,9 +358,69 @@ func (this *EsConn) Bulk(ops []Bulk) (ret []Bulk, err error) {
 	return
 }
 
+// parseRetryAfter understands both forms ES/HTTP may send: a plain number
+// of seconds, or an HTTP-date.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(header); err == nil {
+		if d := time.Until(when); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// retryBulk submits ops, retrying any transient (429/503) failures with
+// exponential backoff and jitter per policy, honoring ES's Retry-After
+// header when it asks for longer than our own backoff. It gives up once
+// policy.MaxAttempts or policy.MaxElapsedTime is exceeded, returning an
+// error that names the docs still failing.
+func (this *EsConn) retryBulk(ctx context.Context, ops []Bulk, policy RetryPolicy) error {
+	leftover := ops
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		result, retryAfter, err := this.bulkOnce(ctx, leftover)
+		if err != nil {
+			return err
+		}
+		if len(result) == 0 {
+			return nil
+		}
+		if attempt+1 >= policy.MaxAttempts {
+			return fmt.Errorf("giving up after %d attempts, %d docs still failing: %s", attempt+1, len(result), failedIds(result))
+		}
+		wait := policy.Backoff(attempt)
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if time.Since(start)+wait > policy.MaxElapsedTime {
+			return fmt.Errorf("giving up after %s, %d docs still failing: %s", policy.MaxElapsedTime, len(result), failedIds(result))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		leftover = result
+	}
+}
+
+func failedIds(ops []Bulk) []string {
+	ids := make([]string, len(ops))
+	for i, op := range ops {
+		ids[i] = op.Id
+	}
+	return ids
+}
+
 // delete index of EsConn
-func (this *EsConn) DeleteIndex() (err error) {
-	req, err := http.NewRequest("DELETE", this.hostPrefix+this.path, bytes.NewReader([]byte{}))
+func (this *EsConn) DeleteIndex(ctx context.Context) (err error) {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", this.hostPrefix+this.path, bytes.NewReader([]byte{}))
 	if err != nil {
 		return
 	}
@@ -180,7 +428,7 @@ func (this *EsConn) DeleteIndex() (err error) {
 	return
 }
 
-func (this *EsConn) PutIndex(metaString string, repls int, shards int) (err error) {
+func (this *EsConn) PutIndex(ctx context.Context, metaString string, repls int, shards int) (err error) {
 	// meta - all metadata including the old index name (top-level)
 	meta := make(map[string]Index)
 	err = json.Unmarshal([]byte(metaString), &meta)
@@ -195,6 +443,10 @@ func (this *EsConn) PutIndex(metaString string, repls int, shards int) (err erro
 	for k := range meta[oldIndexName].Mappings {
 		this.types = append(this.types, k)
 	}
+	// Mappings is a map, so iteration order above is randomized per run;
+	// sort so repeated PutIndex calls (and anything relying on a stable
+	// this.types order) behave the same way every time.
+	sort.Strings(this.types)
 	log.Printf("Types %s", this.types)
 	metaVal := meta[oldIndexName]
 	metaVal.Aliases = map[string]Any{} // clear all aliases
@@ -211,7 +463,7 @@ func (this *EsConn) PutIndex(metaString string, repls int, shards int) (err erro
 		return
 	}
 
-	reqMapping, err := http.NewRequest("PUT", this.hostPrefix+this.path, bytes.NewBuffer(metaBlob))
+	reqMapping, err := http.NewRequestWithContext(ctx, "PUT", this.hostPrefix+this.path, bytes.NewBuffer(metaBlob))
 	if err != nil {
 		return
 	}
@@ -219,8 +471,12 @@ func (this *EsConn) PutIndex(metaString string, repls int, shards int) (err erro
 	return
 }
 
-func (this *EsConn) GetIndex() (string, error) {
-	resp, err := this.client.Get(this.hostPrefix + this.path)
+func (this *EsConn) GetIndex(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", this.hostPrefix+this.path, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := this.client.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -246,6 +502,23 @@ func (this *EsConn) GetIndex() (string, error) {
 	for k := range meta[indexName].Mappings {
 		this.types = append(this.types, k)
 	}
+	// Mappings is a map, so iteration order above is randomized per run;
+	// sort before StreamTo's --resume logic relies on this.types having a
+	// stable, reproducible order to find where the interrupted run left off.
+	sort.Strings(this.types)
+	if len(this.typesFilter) > 0 {
+		allowed := map[string]bool{}
+		for _, t := range this.typesFilter {
+			allowed[t] = true
+		}
+		var filtered []string
+		for _, t := range this.types {
+			if allowed[t] {
+				filtered = append(filtered, t)
+			}
+		}
+		this.types = filtered
+	}
 	metaVal := meta[indexName]
 	// clear aliases
 	metaVal.Aliases = map[string]Any{} // clear all aliases
@@ -261,58 +534,164 @@ func (this *EsConn) GetIndex() (string, error) {
 	return string(data), nil
 }
 
-func (this *EsConn) readBulk(typeName string, window, bulkSize int, dest chan<- []Bulk) {
-	log.Printf("Exporting type: `%s`", typeName)
-	scroll, err := this.NewScroll(typeName, window)
+// EstimateTotal asks ES for the document count of the index being read, so
+// the progress bar has a total to work against. Byte size isn't known ahead
+// of time for an ES source, so it is reported as -1.
+// EstimateTotal counts how many docs this.query (and, for a typed cluster,
+// this.typesFilter) will actually match, so the progress bar's denominator
+// reflects a filtered export/copy instead of the whole index.
+func (this *EsConn) EstimateTotal(ctx context.Context) (docs int64, bytes int64, err error) {
+	url := this.hostPrefix + this.path
+	if !this.isTypeless(ctx) && len(this.typesFilter) > 0 {
+		url += "/" + strings.Join(this.typesFilter, ",")
+	}
+	url += "/_count"
+	body := map[string]Any{}
+	if this.query != nil {
+		body["query"] = this.query
+	}
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(string(bodyBytes)))
+	if err != nil {
+		return
+	}
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	var v struct {
+		Count int64 `json:"count"`
+	}
+	if err = json.Unmarshal(data, &v); err != nil {
+		return
+	}
+	return v.Count, -1, nil
+}
+
+// closeScroll releases the server-side scroll context; best-effort since
+// it's called on the abort/cleanup path where the cluster may already be
+// gone or the context already cancelled.
+func (this *EsConn) closeScroll(scrollID string) {
+	if scrollID == "" {
+		return
+	}
+	req, err := http.NewRequestWithContext(context.Background(), "DELETE", this.hostPrefix+"/_search/scroll?scroll_id="+scrollID, bytes.NewReader([]byte{}))
+	if err != nil {
+		return
+	}
+	readRequest(this.client, req)
+}
+
+// readBulk drains one scroll - the whole type if slices <= 1, or slice
+// sliceId of slices otherwise - into dest. resumeFrom, if non-empty, starts
+// the scroll with search_after right after that _id instead of at the top
+// of the type.
+func (this *EsConn) readBulk(ctx context.Context, typeName string, window, bulkSize int, dest chan<- []Bulk, sliceId, slices int, resumeFrom string) error {
+	if resumeFrom != "" {
+		log.Printf("Exporting type: `%s` (slice %d/%d), resuming after _id %s", typeName, sliceId, slices, resumeFrom)
+	} else {
+		log.Printf("Exporting type: `%s` (slice %d/%d)", typeName, sliceId, slices)
+	}
+	scroll, hits, err := this.NewScroll(ctx, typeName, window, sliceId, slices, resumeFrom)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer this.closeScroll(scroll.id)
 	batcher := Batcher{size: bulkSize, dest: dest}
 	defer batcher.Flush()
-	for hits, err := scroll.Next(); len(hits) != 0 && err == nil; hits, err = scroll.Next() {
+	for len(hits) > 0 {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		log.Printf("Fetched %d\n", len(hits))
 		for _, h := range hits {
-			bytes, err := json.Marshal(h["_source"])
+			docBytes, err := json.Marshal(h["_source"])
 			if err != nil {
-				panic(err)
+				return err
 			}
-			batcher.Put(Bulk{Id: h["_id"].(string), Type: typeName, Doc: bytes})
+			batcher.Put(Bulk{Id: h["_id"].(string), Type: typeName, Doc: docBytes})
+		}
+		hits, err = scroll.Next(ctx)
+		if err != nil {
+			return err
 		}
 	}
+	return ctx.Err()
 }
 
-func (this *EsConn) StreamTo(window, bulkSize int, dest chan []Bulk) {
+// StreamTo exports every discovered type in turn. If SetResumeFrom named a
+// type, every type before it is skipped outright and that type itself
+// resumes via search_after instead of being rescanned from the start; types
+// after it are unaffected. Slicing partitions a type's docs by a hash, not
+// by _id range, so a single checkpointed _id cannot safely seed every
+// slice's cutoff - some slices would skip docs of their own they hadn't
+// reached yet. Callers must not combine resume with slices > 1; exportTask
+// enforces that before SetResumeFrom is ever called.
+func (this *EsConn) StreamTo(ctx context.Context, window, bulkSize int, dest chan []Bulk, stats *Stats, slices int) error {
 	defer close(dest)
+	skipping := this.resumeType != ""
 	for _, t := range this.types {
-		this.readBulk(t, window, bulkSize, dest)
+		if skipping {
+			if t != this.resumeType {
+				continue
+			}
+			skipping = false
+		}
+		resumeFrom := ""
+		if t == this.resumeType {
+			resumeFrom = this.resumeId
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if slices <= 1 {
+			if err := this.readBulk(ctx, t, window, bulkSize, dest, 0, 1, resumeFrom); err != nil {
+				return err
+			}
+			continue
+		}
+		sliceGroup, sliceCtx := newErrGroup(ctx)
+		for i := 0; i < slices; i++ {
+			i := i
+			sliceGroup.Go(func() error { return this.readBulk(sliceCtx, t, window, bulkSize, dest, i, slices, resumeFrom) })
+		}
+		if err := sliceGroup.Wait(); err != nil {
+			return err
+		}
 	}
-	return
+	return nil
 }
 
-func (this *EsConn) AcceptFrom(parallel int, src chan []Bulk) (err error) {
-	var group sync.WaitGroup
-	group.Add(parallel)
+func (this *EsConn) AcceptFrom(ctx context.Context, parallel int, src chan []Bulk, stats *Stats, retry RetryPolicy) error {
+	workers, workerCtx := newErrGroup(ctx)
 	for i := 0; i < parallel; i++ {
-		go func() {
-			var leftover []Bulk
-			for batch := range src {
-				batch = append(batch, leftover...)
-				leftover, err = this.Bulk(batch)
-				if err != nil {
-					panic(err)
-				}
-				log.Printf("Imported %d/%d", len(batch)-len(leftover), len(batch))
-			}
-			for len(leftover) > 0 {
-				log.Printf("Pushing in last %d", len(leftover))
-				leftover, err = this.Bulk(leftover)
-				if err != nil {
-					panic(err)
+		workers.Go(func() error {
+			for {
+				select {
+				case <-workerCtx.Done():
+					return workerCtx.Err()
+				case batch, ok := <-src:
+					if !ok {
+						return nil
+					}
+					if err := this.retryBulk(workerCtx, batch, retry); err != nil {
+						return err
+					}
+					for _, b := range batch {
+						stats.AddDoc(len(b.Doc))
+					}
+					log.Printf("Imported %d", len(batch))
 				}
 			}
-			group.Done()
-		}()
+		})
 	}
-	group.Wait()
-	return
+	return workers.Wait()
 }
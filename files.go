@@ -2,15 +2,23 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 type FileSource struct {
-	src    *os.File
-	reader *bufio.Reader
+	files   []string
+	current int
+	src     *os.File
+	reader  *bufio.Reader
 }
 
 var _ DataSource = &FileSource{}
@@ -40,67 +48,398 @@ func (bulk Bulk) Store(wrt io.Writer) error {
 	return err
 }
 
+// resolveSourceFiles expands in as a glob (e.g. "out.*.ndjson.gz") when it
+// looks like one, otherwise treats it as a single literal path. Glob matches
+// are sorted lexically, which lines up with the zero-padded part numbers
+// FileSink produces.
+func resolveSourceFiles(in string) ([]string, error) {
+	if !strings.ContainsAny(in, "*?[") {
+		return []string{in}, nil
+	}
+	matches, err := filepath.Glob(in)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("goes: no files match %q", in)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
 func NewFileSource(in string) (*FileSource, error) {
-	src, err := os.Open(in)
+	files, err := resolveSourceFiles(in)
 	if err != nil {
 		return nil, err
 	}
-	reader := bufio.NewReader(src)
-	return &FileSource{src: src, reader: reader}, nil
+	src := &FileSource{files: files}
+	if err := src.openNext(); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// openNext closes the current part, if any, and opens the next one in
+// this.files, transparently gunzipping it when it starts with the gzip
+// magic bytes. For every part after the first, the repeated index metadata
+// header is skipped so StreamTo only sees document lines.
+func (this *FileSource) openNext() error {
+	if this.src != nil {
+		this.src.Close()
+	}
+	if this.current >= len(this.files) {
+		return io.EOF
+	}
+	f, err := os.Open(this.files[this.current])
+	if err != nil {
+		return err
+	}
+	this.src = f
+
+	magic := make([]byte, 2)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var r io.Reader = f
+	if n == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		r = gz
+	}
+	this.reader = bufio.NewReader(r)
+
+	if this.current > 0 {
+		if _, err := this.reader.ReadString('\n'); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	this.current++
+	return nil
 }
 
-func (this *FileSource) GetIndex() (string, error) {
+func (this *FileSource) GetIndex(ctx context.Context) (string, error) {
 	return this.reader.ReadString('\n')
 }
 
-func (this *FileSource) StreamTo(window, bulkSize int, dest chan []Bulk) {
+// EstimateTotal can't know the doc count without scanning the whole file, so
+// it reports the combined size of every part instead; the progress bar
+// falls back to a bytes-based estimate for file sources.
+func (this *FileSource) EstimateTotal(ctx context.Context) (docs int64, bytes int64, err error) {
+	var total int64
+	for _, path := range this.files {
+		fi, statErr := os.Stat(path)
+		if statErr != nil {
+			return 0, 0, statErr
+		}
+		total += fi.Size()
+	}
+	return -1, total, nil
+}
+
+func (this *FileSource) StreamTo(ctx context.Context, window, bulkSize int, dest chan []Bulk, stats *Stats, slices int) error {
 	defer close(dest)
 	defer this.src.Close()
 	batcher := Batcher{size: bulkSize, dest: dest}
 	defer batcher.Flush()
-	for {
+	for ctx.Err() == nil {
 		bulk, err := ParseBulk(this.reader)
 		if err == io.EOF {
-			break
+			if err := this.openNext(); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			continue
 		}
 		if err != nil {
-			panic(err)
+			return err
 		}
 		batcher.Put(bulk)
 	}
+	return ctx.Err()
 }
 
-type FileSink struct {
-	sink *os.File
+// Checkpoint is the on-disk schema of the "<outfile>.ckpt" sidecar FileSink
+// writes every checkpointEvery batches during a long export, so --resume (or
+// external tooling polling the file) can see how far a run has gotten.
+// Type and LastId name the last document flushed to disk; SearchAfter
+// carries the same value already shaped the way EsConn's search_after
+// pagination expects it ("sort":["_id"]). Offset is the exact byte length
+// this.basePath had reached right after that document was written, always a
+// clean record (and, for gzip output, gzip member) boundary - --resume
+// truncates straight back to it instead of guessing from file content, so a
+// doc written after the last checkpoint but before a crash is discarded
+// from disk and then re-fetched from ES, rather than kept and duplicated.
+//
+//	{
+//	  "type": "tweet",
+//	  "last_id": "908213",
+//	  "search_after": ["908213"],
+//	  "offset": 409600
+//	}
+type Checkpoint struct {
+	Type        string `json:"type"`
+	LastId      string `json:"last_id"`
+	SearchAfter []Any  `json:"search_after"`
+	Offset      int64  `json:"offset"`
 }
 
-func NewFileSink(out string) (*FileSink, error) {
-	sink, err := os.Create(out)
+func checkpointPath(outPath string) string {
+	return outPath + ".ckpt"
+}
+
+// LoadCheckpoint reads the checkpoint sidecar for outPath, returning a nil
+// Checkpoint (and nil error) if none exists yet.
+func LoadCheckpoint(outPath string) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(checkpointPath(outPath))
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
 		return nil, err
 	}
-	return &FileSink{sink: sink}, nil
+	var ckpt Checkpoint
+	if err := json.Unmarshal(data, &ckpt); err != nil {
+		return nil, err
+	}
+	return &ckpt, nil
 }
 
-func (this *FileSink) PutIndex(meta string, repls, shards int) error {
+// FileSink writes NDJSON to one or more parts on disk. A part whose path
+// ends in ".gz" is transparently gzip-compressed; when splitSize is
+// positive, the sink rotates into zero-padded parts (out.000.ndjson.gz,
+// out.001.ndjson.gz, ...) once the current part reaches that many bytes of
+// document payload, repeating the index metadata header at the top of each.
+// Every checkpointEvery batches it also overwrites the "<out>.ckpt" sidecar
+// with a Checkpoint for the last document written, deleting it again once
+// AcceptFrom finishes cleanly.
+type FileSink struct {
+	basePath         string
+	compressLevel    int
+	splitSize        int64
+	checkpointEvery  int
+	resuming         bool
+	partNum          int
+	metaLine         string
+	file             *os.File
+	gz               *gzip.Writer
+	sink             io.Writer
+	written          int64
+	batchesSinceCkpt int
+}
+
+// NewFileSink creates a fresh sink at out, truncating any existing file.
+func NewFileSink(out string, compressLevel int, splitSize int64, checkpointEvery int) (*FileSink, error) {
+	sink := &FileSink{basePath: out, compressLevel: compressLevel, splitSize: splitSize, checkpointEvery: checkpointEvery}
+	if err := sink.openPart(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+// ResumeFileSink reopens out for a --resume export: it cannot be combined
+// with splitSize, since a checkpoint only records a position in one file.
+// The existing file is truncated back to exactly offset - the position
+// Checkpoint.Offset recorded the instant the checkpoint being resumed from
+// was written - discarding anything written after it, gzip member boundary
+// included, so new batches can be appended (or, for ".gz" out, a fresh
+// gzip member started) right there with nothing left dangling.
+func ResumeFileSink(out string, compressLevel int, checkpointEvery int, offset int64) (*FileSink, error) {
+	sink := &FileSink{basePath: out, compressLevel: compressLevel, checkpointEvery: checkpointEvery, resuming: true}
+	if err := sink.openPartForResume(offset); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+// partPath returns the path of part n of base: the part number is inserted
+// right before base's first '.', so "out.ndjson.gz" becomes
+// "out.000.ndjson.gz". Splitting is disabled (n is always 0, path is base
+// unchanged) unless this.splitSize is positive.
+func partPath(base string, n int) string {
+	if idx := strings.Index(base, "."); idx >= 0 {
+		return fmt.Sprintf("%s.%03d%s", base[:idx], n, base[idx:])
+	}
+	return fmt.Sprintf("%s.%03d", base, n)
+}
+
+func (this *FileSink) partFileName() string {
+	if this.splitSize <= 0 {
+		return this.basePath
+	}
+	return partPath(this.basePath, this.partNum)
+}
+
+func (this *FileSink) openPart() error {
+	path := this.partFileName()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	this.file = f
+	this.written = 0
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewWriterLevel(f, this.compressLevel)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		this.gz = gz
+		this.sink = gz
+	} else {
+		this.gz = nil
+		this.sink = f
+	}
+	if this.metaLine != "" {
+		if _, err := fmt.Fprintf(this.sink, "%s\n", this.metaLine); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openPartForResume reopens this.basePath truncated to offset - the exact
+// boundary the checkpoint being resumed from recorded - and positioned to
+// append from there, per the rules documented on ResumeFileSink.
+func (this *FileSink) openPartForResume(offset int64) error {
+	path := this.basePath
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	this.file = f
+	this.written = 0
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewWriterLevel(f, this.compressLevel)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		this.gz = gz
+		this.sink = gz
+	} else {
+		this.gz = nil
+		this.sink = f
+	}
+	return nil
+}
+
+func (this *FileSink) closePart() error {
+	var err error
+	if this.gz != nil {
+		err = this.gz.Close()
+	}
+	if cerr := this.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (this *FileSink) PutIndex(ctx context.Context, meta string, repls, shards int) error {
 	// FIXME: should parse & rewrite shards and repls
+	this.metaLine = meta
+	if this.resuming {
+		// The header is already sitting at the top of the file being resumed.
+		return nil
+	}
 	_, err := fmt.Fprintf(this.sink, "%s\n", meta)
 	return err
 }
 
-func (this *FileSink) AcceptFrom(parallel int, src chan []Bulk) error {
-	defer this.sink.Close()
+// writeCheckpoint overwrites the "<out>.ckpt" sidecar with last's position
+// and the exact byte offset this.basePath has reached right now, a no-op if
+// checkpointing is disabled (checkpointEvery <= 0). For gzip output this
+// closes the current gzip member and opens a fresh one first: Flush alone
+// (used every batch for live tailing) leaves a member without its trailer,
+// which isn't a safe place to truncate back to and start a new member
+// after, but Close does finish one off cleanly.
+func (this *FileSink) writeCheckpoint(last Bulk) error {
+	if this.checkpointEvery <= 0 {
+		return nil
+	}
+	if this.gz != nil {
+		if err := this.gz.Close(); err != nil {
+			return err
+		}
+		gz, err := gzip.NewWriterLevel(this.file, this.compressLevel)
+		if err != nil {
+			return err
+		}
+		this.gz = gz
+		this.sink = gz
+	}
+	offset, err := this.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	ckpt := Checkpoint{Type: last.Type, LastId: last.Id, SearchAfter: []Any{last.Id}, Offset: offset}
+	data, err := json.MarshalIndent(ckpt, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(checkpointPath(this.basePath), data, 0644)
+}
+
+func (this *FileSink) AcceptFrom(ctx context.Context, parallel int, src chan []Bulk, stats *Stats, retry RetryPolicy) error {
+	defer this.closePart()
 	for batch := range src {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		for _, b := range batch {
 			err := b.Store(this.sink)
 			if err != nil {
 				return err
 			}
+			stats.AddDoc(len(b.Doc))
+			this.written += int64(len(b.Doc))
+			if this.splitSize > 0 && this.written >= this.splitSize {
+				if err := this.closePart(); err != nil {
+					return err
+				}
+				this.partNum++
+				if err := this.openPart(); err != nil {
+					return err
+				}
+			}
+		}
+		// Flush, not Close, so a reader can follow along with a partial dump
+		// while the copy is still running.
+		if this.gz != nil {
+			if err := this.gz.Flush(); err != nil {
+				return err
+			}
 		}
+		if len(batch) > 0 {
+			this.batchesSinceCkpt++
+			if this.checkpointEvery > 0 && this.batchesSinceCkpt >= this.checkpointEvery {
+				if err := this.writeCheckpoint(batch[len(batch)-1]); err != nil {
+					return err
+				}
+				this.batchesSinceCkpt = 0
+			}
+		}
+	}
+	if err := os.Remove(checkpointPath(this.basePath)); err != nil && !os.IsNotExist(err) {
+		return err
 	}
 	return nil
 }
 
-func (this *FileSink) DeleteIndex() error { return nil }
+func (this *FileSink) DeleteIndex(ctx context.Context) error { return nil }
 
 var _ DataSink = &FileSink{}
@@ -1,18 +1,37 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	//	"github.com/davecheney/profile"
+	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type Any interface{}
 
 // ES scroll state - base64 of Id + connection
 type Scroll struct {
-	id string
-	es *EsConn
+	id          string
+	es          *EsConn
+	typeName    string
+	size        int
+	sliceId     int
+	slices      int
+	searchAfter []Any // non-nil switches Next to search_after pagination instead of the scroll id
 }
 
 // Index metadata
@@ -65,14 +84,18 @@ type IndexSettings struct {
 }
 
 type DataSource interface {
-	GetIndex() (string, error)
-	StreamTo(window int, dest chan []Bulk)
+	GetIndex(ctx context.Context) (string, error)
+	// EstimateTotal returns a best-effort estimate of the docs and bytes
+	// a StreamTo call will produce, used to size the progress bar. Either
+	// value may be -1 if it cannot be determined up front.
+	EstimateTotal(ctx context.Context) (docs int64, bytes int64, err error)
+	StreamTo(ctx context.Context, window, bulkSize int, dest chan []Bulk, stats *Stats, slices int) error
 }
 
 type DataSink interface {
-	PutIndex(meta string, repls, shards int) error
-	DeleteIndex() error
-	AcceptFrom(src chan []Bulk) error
+	PutIndex(ctx context.Context, meta string, repls, shards int) error
+	DeleteIndex(ctx context.Context) error
+	AcceptFrom(ctx context.Context, parallel int, src chan []Bulk, stats *Stats, retry RetryPolicy) error
 }
 
 type DataFlow interface {
@@ -80,49 +103,305 @@ type DataFlow interface {
 	DataSource
 }
 
-func Copy(src DataSource, sink DataSink, p Params) error {
-	index, err := src.GetIndex()
+// Stats holds concurrency-safe running totals for a copy job; only
+// AcceptFrom implementations bump it, once per document actually written to
+// the sink, while the progress bar only ever reads it. StreamTo must not
+// also bump it for the same document read off the source - both sides of
+// one Copy share this same Stats, so that would double every count.
+type Stats struct {
+	docs  int64
+	bytes int64
+}
+
+func (this *Stats) AddDoc(size int) {
+	atomic.AddInt64(&this.docs, 1)
+	atomic.AddInt64(&this.bytes, int64(size))
+}
+
+func (this *Stats) Snapshot() (docs, bytes int64) {
+	return atomic.LoadInt64(&this.docs), atomic.LoadInt64(&this.bytes)
+}
+
+// RetryPolicy controls how EsConn.AcceptFrom retries a batch that ES
+// rejected with a transient 429/503. Backoff grows exponentially from
+// InitialInterval up to MaxInterval, jittered by RandomizationFactor; the
+// whole retry run for a single batch gives up once MaxAttempts or
+// MaxElapsedTime is exceeded, whichever comes first.
+type RetryPolicy struct {
+	InitialInterval     time.Duration
+	MaxInterval         time.Duration
+	Multiplier          float64
+	RandomizationFactor float64
+	MaxElapsedTime      time.Duration
+	MaxAttempts         int
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		InitialInterval:     500 * time.Millisecond,
+		MaxInterval:         60 * time.Second,
+		Multiplier:          1.5,
+		RandomizationFactor: 0.5,
+		MaxElapsedTime:      15 * time.Minute,
+		MaxAttempts:         10,
+	}
+}
+
+// Backoff returns the jittered delay to sleep before retry attempt n (0-based).
+func (this RetryPolicy) Backoff(attempt int) time.Duration {
+	interval := float64(this.InitialInterval) * math.Pow(this.Multiplier, float64(attempt))
+	if interval > float64(this.MaxInterval) {
+		interval = float64(this.MaxInterval)
+	}
+	delta := interval * this.RandomizationFactor
+	low := interval - delta
+	high := interval + delta
+	return time.Duration(low + rand.Float64()*(high-low))
+}
+
+// errGroup runs a fixed set of tasks concurrently and cancels the shared
+// context as soon as one of them fails, same contract as
+// golang.org/x/sync/errgroup; reimplemented here because this tree has no
+// module/vendor setup to pull the real package in.
+type errGroup struct {
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	err    error
+	cancel context.CancelFunc
+}
+
+func newErrGroup(ctx context.Context) (*errGroup, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	return &errGroup{cancel: cancel}, ctx
+}
+
+func (this *errGroup) Go(fn func() error) {
+	this.wg.Add(1)
+	go func() {
+		defer this.wg.Done()
+		if err := fn(); err != nil {
+			this.mu.Lock()
+			if this.err == nil {
+				this.err = err
+				this.cancel()
+			}
+			this.mu.Unlock()
+		}
+	}()
+}
+
+func (this *errGroup) Wait() error {
+	this.wg.Wait()
+	this.cancel()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.err
+}
+
+// progressTick is how often the progress bar repaints.
+const progressTick = time.Second
+
+// Progress renders a periodic "docs/bytes processed, rate, ETA" line to
+// stderr for a running copy job.
+type Progress struct {
+	stats      *Stats
+	totalDocs  int64
+	totalBytes int64
+	start      time.Time
+	done       chan struct{}
+}
+
+func NewProgress(stats *Stats, totalDocs, totalBytes int64) *Progress {
+	return &Progress{stats: stats, totalDocs: totalDocs, totalBytes: totalBytes, start: time.Now(), done: make(chan struct{})}
+}
+
+func (this *Progress) Start(tick time.Duration) {
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				this.render()
+			case <-this.done:
+				this.render()
+				fmt.Fprintln(os.Stderr)
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the progress goroutine and prints a final, accurate line.
+func (this *Progress) Stop() {
+	close(this.done)
+}
+
+func (this *Progress) render() {
+	docs, bytes := this.stats.Snapshot()
+	elapsed := time.Since(this.start).Seconds()
+	rate := float64(0)
+	if elapsed > 0 {
+		rate = float64(docs) / elapsed
+	}
+	if this.totalDocs > 0 {
+		eta := "?"
+		if rate > 0 {
+			remaining := this.totalDocs - docs
+			if remaining < 0 {
+				remaining = 0
+			}
+			eta = time.Duration(float64(remaining) / rate * float64(time.Second)).String()
+		}
+		fmt.Fprintf(os.Stderr, "\r%d/%d docs, %d bytes, %.1f docs/s, ETA %s    ", docs, this.totalDocs, bytes, rate, eta)
+	} else {
+		fmt.Fprintf(os.Stderr, "\r%d docs, %d bytes, %.1f docs/s    ", docs, bytes, rate)
+	}
+}
+
+var errAborted = errors.New("goes: copy aborted by signal")
+
+func Copy(src DataSource, sink DataSink, p Params) (err error) {
+	// deadlineCtx only ever expires from --deadline, never from the signal
+	// handler below, so it's the context AcceptFrom dispatches bulks with:
+	// a batch already picked up off the pipe must be allowed to finish
+	// ("drain in-flight bulks"), not have its in-flight HTTP call aborted
+	// the instant SIGINT/SIGTERM arrives. ctx additionally gets cancelled
+	// by the signal handler, so it's used to stop producing new work
+	// (StreamTo fetching another scroll page) - StreamTo closes the pipe
+	// on the way out, which is what actually makes AcceptFrom stop.
+	deadlineCtx := context.Background()
+	if p.deadline > 0 {
+		var cancel context.CancelFunc
+		deadlineCtx, cancel = context.WithTimeout(deadlineCtx, p.deadline)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(deadlineCtx)
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	aborted := int32(0)
+	go func() {
+		if _, ok := <-sigCh; ok {
+			log.Printf("Received interrupt, draining in-flight work and shutting down...")
+			atomic.StoreInt32(&aborted, 1)
+			cancel()
+		}
+	}()
+
+	index, err := src.GetIndex(ctx)
 	if err != nil {
 		return err
 	}
 	if p.force {
-		sink.DeleteIndex()
+		sink.DeleteIndex(ctx)
 	}
-	err = sink.PutIndex(index, p.repls, p.shards)
+	err = sink.PutIndex(ctx, index, p.repls, p.shards)
 	if err != nil {
 		return err
 	}
+
+	totalDocs, totalBytes, err := src.EstimateTotal(ctx)
+	if err != nil {
+		log.Printf("Could not estimate total size: %v", err)
+		totalDocs, totalBytes = -1, -1
+	}
+
+	stats := &Stats{}
+	if !p.silent && !p.noProgress {
+		progress := NewProgress(stats, totalDocs, totalBytes)
+		progress.Start(progressTick)
+		defer progress.Stop()
+	}
+
+	retry := DefaultRetryPolicy()
+	retry.MaxInterval = p.retryMaxInterval
+	retry.MaxElapsedTime = p.retryMaxElapsed
+	retry.MaxAttempts = p.retryMaxAttempts
+
 	pipe := make(chan []Bulk, 10)
-	go src.StreamTo(p.window, pipe)
-	return sink.AcceptFrom(pipe)
+	group, gctx := newErrGroup(ctx)
+	group.Go(func() error { return src.StreamTo(gctx, p.window, p.bulkSize, pipe, stats, p.slices) })
+	group.Go(func() error { return sink.AcceptFrom(deadlineCtx, p.parallel, pipe, stats, retry) })
+	err = group.Wait()
+
+	finalDocs, finalBytes := stats.Snapshot()
+	if atomic.LoadInt32(&aborted) == 1 {
+		log.Printf("Aborted: copied %d docs (%d bytes) before shutdown", finalDocs, finalBytes)
+		if err == nil {
+			err = errAborted
+		}
+	} else if err == nil && !p.silent {
+		log.Printf("Done: copied %d docs (%d bytes)", finalDocs, finalBytes)
+	}
+	return err
 }
 
 func exportTask(p Params) (err error) {
 	log.Printf("Export %s --> %s\n", p.in, p.out)
-	if !p.force {
-		_, err := os.Open(p.out)
-		if err == nil {
-			log.Fatalf("File `%s` already exits, use --force to overwrite.", p.out)
+	var ckpt *Checkpoint
+	if p.resume {
+		if ckpt, err = LoadCheckpoint(p.out); err != nil {
+			return
+		}
+	}
+	if ckpt == nil {
+		if !p.force {
+			_, err = os.Open(p.out)
+			if err == nil {
+				log.Fatalf("File `%s` already exits, use --force to overwrite.", p.out)
+			}
+			err = nil
+		}
+	}
+	var sink *FileSink
+	if ckpt != nil {
+		if p.splitSize > 0 {
+			return fmt.Errorf("goes: --resume cannot be combined with --split-size")
+		}
+		if p.slices > 1 {
+			return fmt.Errorf("goes: --resume cannot be combined with --slices > 1, a single checkpointed _id cannot seed every slice's cutoff safely")
 		}
+		log.Printf("Resuming export from checkpoint: type=%s last_id=%s offset=%d", ckpt.Type, ckpt.LastId, ckpt.Offset)
+		sink, err = ResumeFileSink(p.out, p.compressLevel, p.checkpointEvery, ckpt.Offset)
+	} else {
+		sink, err = NewFileSink(p.out, p.compressLevel, p.splitSize, p.checkpointEvery)
 	}
-	sink, err := NewFileSink(p.out)
 	if err != nil {
 		return
 	}
-	es, err := ConnectES(p.in)
+	es, err := ConnectES(p.in, p.requestTimeout, p.compatV1)
 	if err != nil {
 		return
 	}
-	return Copy(es, sink, p)
+	query, err := configureSource(es, p)
+	if err != nil {
+		return
+	}
+	if ckpt != nil {
+		es.SetResumeFrom(ckpt.Type, ckpt.LastId)
+	}
+	err = Copy(es, sink, p)
+	if err == nil {
+		if sidecarErr := writeQuerySidecar(p.out, p, query); sidecarErr != nil {
+			log.Printf("Could not write query provenance sidecar: %v", sidecarErr)
+		}
+	}
+	return
 }
 
 func importTask(p Params) (err error) {
 	log.Printf("Import %s --> %s", p.in, p.out)
+	if sidecar, sidecarErr := ioutil.ReadFile(p.in + ".query.json"); sidecarErr == nil {
+		log.Printf("Source was produced by a filtered export, provenance: %s", sidecar)
+	}
 	src, err := NewFileSource(p.in)
 	if err != nil {
 		return
 	}
-	es, err := ConnectES(p.out)
+	es, err := ConnectES(p.out, p.requestTimeout, p.compatV1)
 	if err != nil {
 		return
 	}
@@ -131,30 +410,167 @@ func importTask(p Params) (err error) {
 
 func copyTask(p Params) (err error) {
 	log.Printf("Copy %s --> %s\n", p.in, p.out)
-	es1, err := ConnectES(p.in)
+	es1, err := ConnectES(p.in, p.requestTimeout, p.compatV1)
 	if err != nil {
 		return
 	}
-	es2, err := ConnectES(p.out)
+	if _, err = configureSource(es1, p); err != nil {
+		return
+	}
+	es2, err := ConnectES(p.out, p.requestTimeout, p.compatV1)
 	if err != nil {
 		return
 	}
 	return Copy(es1, es2, p)
 }
 
+// parseSize parses a human-readable byte size, e.g. "1GiB" or "512MiB", into
+// a number of bytes. A bare number is taken as bytes already; an empty
+// string means "no limit" and parses to 0.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"TiB", 1 << 40},
+		{"GiB", 1 << 30},
+		{"MiB", 1 << 20},
+		{"KiB", 1 << 10},
+		{"B", 1},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, u.suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("goes: invalid size %q: %v", s, err)
+			}
+			return int64(n * float64(u.scale)), nil
+		}
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// splitCSV splits a comma-separated CLI flag value into a trimmed slice,
+// returning nil for an empty input so callers can treat "unset" and
+// "empty list" the same way.
+func splitCSV(s string) []string {
+	if s == "" {
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
+// loadQuery builds the ES query DSL clause to scroll with, from either
+// --query (a JSON file) or --query-string (wrapped as a query_string
+// clause). Neither set means a plain match_all, signalled by a nil map.
+func loadQuery(p Params) (map[string]Any, error) {
+	if p.queryFile != "" {
+		data, err := ioutil.ReadFile(p.queryFile)
+		if err != nil {
+			return nil, err
+		}
+		var q map[string]Any
+		if err := json.Unmarshal(data, &q); err != nil {
+			return nil, err
+		}
+		return q, nil
+	}
+	if p.queryString != "" {
+		return map[string]Any{"query_string": map[string]Any{"query": p.queryString}}, nil
+	}
+	return nil, nil
+}
+
+// configureSource applies --query/--query-string, --source-include/exclude
+// and --types onto an EsConn acting as the source of an export or copy.
+func configureSource(es *EsConn, p Params) (map[string]Any, error) {
+	query, err := loadQuery(p)
+	if err != nil {
+		return nil, err
+	}
+	if query != nil {
+		es.SetQuery(query)
+	}
+	if p.sourceInclude != "" || p.sourceExclude != "" {
+		es.SetSourceFilter(splitCSV(p.sourceInclude), splitCSV(p.sourceExclude))
+	}
+	if p.types != "" {
+		es.SetTypesFilter(splitCSV(p.types))
+	}
+	return query, nil
+}
+
+// exportProvenance is the schema of the <outfile>.query.json sidecar: the
+// filters that produced a partial dump, so a later import can tell it
+// apart from a full index snapshot.
+type exportProvenance struct {
+	Query         Any      `json:"query,omitempty"`
+	QueryString   string   `json:"query_string,omitempty"`
+	SourceInclude []string `json:"source_include,omitempty"`
+	SourceExclude []string `json:"source_exclude,omitempty"`
+	Types         []string `json:"types,omitempty"`
+}
+
+func writeQuerySidecar(outPath string, p Params, query map[string]Any) error {
+	prov := exportProvenance{
+		Query:         Any(query),
+		QueryString:   p.queryString,
+		SourceInclude: splitCSV(p.sourceInclude),
+		SourceExclude: splitCSV(p.sourceExclude),
+		Types:         splitCSV(p.types),
+	}
+	if prov.Query == nil && prov.QueryString == "" && len(prov.SourceInclude) == 0 && len(prov.SourceExclude) == 0 && len(prov.Types) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(prov, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outPath+".query.json", data, 0644)
+}
+
 type Params struct {
-	in     string
-	out    string
-	window int
-	repls  int
-	shards int
-	force  bool
+	in               string
+	out              string
+	window           int
+	bulkSize         int
+	parallel         int
+	repls            int
+	shards           int
+	force            bool
+	silent           bool
+	noProgress       bool
+	requestTimeout   time.Duration
+	deadline         time.Duration
+	retryMaxInterval time.Duration
+	retryMaxElapsed  time.Duration
+	retryMaxAttempts int
+	slices           int
+	compatV1         bool
+	queryFile        string
+	queryString      string
+	sourceInclude    string
+	sourceExclude    string
+	types            string
+	compressLevel    int
+	splitSize        int64
+	resume           bool
+	checkpointEvery  int
 }
 
 type Command func(Params) error
 
-/**
+/*
+*
 Commands:
+
 	./estool export --in <url-of-index> --out <path-to-store>
 	./estool import --in <path-to-store> --out <url-to-new-index>
 	./estool copy --in <url-of-src-index> --out <url-out-index>
@@ -172,8 +588,28 @@ func main() {
 	output := commands.String("out", "", "output path/URL")
 	force := commands.Bool("force", false, "force overwrite of existing index/file")
 	window := commands.Int("window", 100, "size of scroll/scan window")
+	bulkSize := commands.Int("bulk-size", 500, "number of docs per bulk request")
+	parallel := commands.Int("parallel", 4, "number of parallel bulk import workers")
 	repls := commands.Int("repls", -1, "override number of relicas (import only)")
 	shards := commands.Int("shards", -1, "override number of shards (import only)")
+	silent := commands.Bool("silent", false, "suppress all output, including the progress bar")
+	noProgress := commands.Bool("no-progress", false, "disable the progress bar but keep other logging")
+	requestTimeout := commands.Duration("request-timeout", 30*time.Second, "timeout for a single ES request")
+	deadline := commands.Duration("deadline", 0, "overall deadline for the whole job, 0 for no deadline")
+	retryMaxInterval := commands.Duration("retry-max-interval", 60*time.Second, "cap on exponential backoff between bulk retries")
+	retryMaxElapsed := commands.Duration("retry-max-elapsed", 15*time.Minute, "give up retrying a batch after this much time")
+	retryMaxAttempts := commands.Int("retry-max-attempts", 10, "give up retrying a batch after this many attempts")
+	slices := commands.Int("slices", 1, "number of concurrent sliced scrolls per type")
+	compat := commands.String("compat", "", "set to \"v1\" to force the pre-7.x typed ES API instead of auto-detecting")
+	queryFile := commands.String("query", "", "path to a JSON file with an ES query DSL body, used instead of match_all (export/copy source only)")
+	queryString := commands.String("query-string", "", "Lucene query_string syntax, used instead of match_all (export/copy source only)")
+	sourceInclude := commands.String("source-include", "", "comma-separated list of fields to include via _source filtering")
+	sourceExclude := commands.String("source-exclude", "", "comma-separated list of fields to exclude via _source filtering")
+	types := commands.String("types", "", "comma-separated allowlist of types to copy, overriding the index's discovered types")
+	compressLevel := commands.Int("compress-level", 6, "gzip compression level (1-9) used when --out ends in .gz")
+	splitSize := commands.String("split-size", "", "rotate --out into numbered parts of this size, e.g. 1GiB (export only); --in accepts the matching glob on import")
+	resume := commands.Bool("resume", false, "resume a previously interrupted export from its <out>.ckpt checkpoint file (export only)")
+	checkpointEvery := commands.Int("checkpoint-every", 100, "write the <out>.ckpt checkpoint file after this many batches during export, 0 to disable")
 
 	if len(args) == 1 {
 		log.Printf("No command supplied, valid commands :\n")
@@ -194,7 +630,24 @@ func main() {
 	if *output == "" {
 		log.Fatalf("No out param provided")
 	}
-	err := task(Params{in: *input, out: *output, window: *window, force: *force, repls: *repls, shards: *shards})
+	if *silent {
+		log.SetOutput(ioutil.Discard)
+	}
+	splitSizeBytes, err := parseSize(*splitSize)
+	if err != nil {
+		log.Fatalf("Invalid --split-size: %v", err)
+	}
+	err = task(Params{
+		in: *input, out: *output, window: *window, bulkSize: *bulkSize, parallel: *parallel,
+		force: *force, repls: *repls, shards: *shards, silent: *silent, noProgress: *noProgress,
+		requestTimeout: *requestTimeout, deadline: *deadline,
+		retryMaxInterval: *retryMaxInterval, retryMaxElapsed: *retryMaxElapsed, retryMaxAttempts: *retryMaxAttempts,
+		slices: *slices, compatV1: *compat == "v1",
+		queryFile: *queryFile, queryString: *queryString,
+		sourceInclude: *sourceInclude, sourceExclude: *sourceExclude, types: *types,
+		compressLevel: *compressLevel, splitSize: splitSizeBytes,
+		resume: *resume, checkpointEvery: *checkpointEvery,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}